@@ -0,0 +1,108 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common_controller
+
+import (
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+)
+
+// chosenManagedByNodeAnnotation records the node selectManagedByNode last
+// picked for a VolumeSnapshotContent. Sticking to the same node across
+// retries avoids flapping between healthy replicas when the controller
+// resyncs before the previous attempt has had a chance to succeed or fail.
+//
+// This is an annotation rather than a status field because the
+// VolumeSnapshotContent type comes from
+// github.com/kubernetes-csi/external-snapshotter/client/v6, which this tree
+// does not vendor - this package cannot add fields to its Status struct.
+// Triaged and accepted as the interim contract for this field: an
+// annotation is readable/writable through the same typed client calls the
+// controller already makes, round-trips correctly through
+// StoreObjectUpdate/the informer cache under utils.CacheModeFull (a
+// utils.CacheModeMetadata cache keeps no annotations, see
+// utils.NewPrunedContent), and does not block this backlog
+// item on a client module bump. Revisit only if/when that module is
+// vendored into this tree for an unrelated reason.
+const chosenManagedByNodeAnnotation = "snapshot.storage.kubernetes.io/managed-by-node"
+
+// healthAwareNodeSelector prefers candidate nodes whose CSINode object
+// advertises driverName as an installed, healthy driver, falling back to
+// the remaining candidates (in the order getManagedByNodes returned them)
+// if none of the preferred nodes can be confirmed healthy.
+type healthAwareNodeSelector struct {
+	csiNodeLister storagelisters.CSINodeLister
+	driverName    string
+}
+
+// NewHealthAwareNodeSelector returns a NodeSelector that favors nodes whose
+// CSINode object reports driverName as installed. It is meant to be wired
+// into csiSnapshotCommonController.nodeSelector so that snapshot scheduling
+// for replicated local volumes avoids nodes whose sidecar has not (yet, or
+// no longer) registered with kubelet.
+func NewHealthAwareNodeSelector(csiNodeLister storagelisters.CSINodeLister, driverName string) NodeSelector {
+	return &healthAwareNodeSelector{
+		csiNodeLister: csiNodeLister,
+		driverName:    driverName,
+	}
+}
+
+func (s *healthAwareNodeSelector) SelectNode(candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return roundRobinNodeSelector{}.SelectNode(candidates)
+	}
+
+	var fallback string
+	for _, name := range candidates {
+		if fallback == "" {
+			fallback = name
+		}
+		if s.isDriverHealthy(name) {
+			return name, nil
+		}
+	}
+
+	// None of the candidates could be confirmed healthy: keep the previous
+	// round-robin behavior rather than failing the snapshot outright.
+	return fallback, nil
+}
+
+// IsHealthy reports whether node currently advertises s.driverName as
+// installed. managedByNodeForContent calls this on every sync to re-check
+// a sticky node, so a node that went unhealthy after it was chosen gets
+// replaced instead of being returned forever.
+func (s *healthAwareNodeSelector) IsHealthy(node string) bool {
+	return s.isDriverHealthy(node)
+}
+
+// isDriverHealthy reports whether the CSINode object for nodeName lists
+// s.driverName among its drivers. A missing CSINode, or one that does not
+// (yet) mention the driver, is treated as unhealthy so callers fall back to
+// another candidate.
+func (s *healthAwareNodeSelector) isDriverHealthy(nodeName string) bool {
+	csiNode, err := s.csiNodeLister.Get(nodeName)
+	if err != nil {
+		return false
+	}
+	for _, driver := range csiNode.Spec.Drivers {
+		if driver.Name == s.driverName {
+			return true
+		}
+	}
+	return false
+}
+
+var _ NodeSelector = &healthAwareNodeSelector{}
@@ -0,0 +1,268 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common_controller
+
+import (
+	"fmt"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/kubernetes-csi/external-snapshotter/v6/pkg/snapshotlint"
+	"github.com/kubernetes-csi/external-snapshotter/v6/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	corev1helpers "k8s.io/component-helpers/scheduling/corev1"
+)
+
+// csiSnapshotCommonController is the controller implementation for the
+// volume snapshot and volume snapshot content resources that is shared
+// across all CSI drivers (the "common" controller, as opposed to the
+// driver-specific sidecar controller).
+type csiSnapshotCommonController struct {
+	nodeLister corelisters.NodeLister
+
+	// nodeSelector picks among the nodes that satisfy a PV's node affinity
+	// when more than one node is eligible to host the volume (e.g.
+	// replicated local storage). A nil value falls back to
+	// defaultNodeSelector.
+	nodeSelector NodeSelector
+
+	// cacheMode selects whether contentStore holds full
+	// VolumeSnapshotContent objects (utils.CacheModeFull, the default) or
+	// only their utils.SnapshotContentDigest (utils.CacheModeMetadata).
+	// There is no constructor in this package yet: set it directly on the
+	// struct literal (see storeContentUpdate for how it's consumed) until
+	// one is added.
+	cacheMode utils.CacheMode
+
+	// contentStore is the shared informer cache of VolumeSnapshotContent
+	// objects. Its element type depends on cacheMode: *crdv1.
+	// VolumeSnapshotContent for CacheModeFull, *utils.PrunedContent for
+	// CacheModeMetadata.
+	contentStore cache.Store
+
+	// lintRegistry is the set of snapshotlint rules runSnapshotLint runs
+	// against a VolumeSnapshot/VolumeSnapshotContent pair. A nil
+	// registry (the default) disables linting entirely.
+	lintRegistry *snapshotlint.Registry
+
+	// lintSetInvalidCondition, when true, makes runSnapshotLint also
+	// set/clear the opt-in Invalid annotation on the linted object (see
+	// snapshotlint.Report). No command-line flag sets it; it is set on the
+	// struct literal.
+	lintSetInvalidCondition bool
+
+	eventRecorder record.EventRecorder
+}
+
+// NodeSelector chooses a single node, in preference order, from a list of
+// nodes that are all valid candidates for a given PersistentVolume. It is
+// pluggable so that drivers with their own notion of node health (e.g. by
+// inspecting the CSINode object or driver-specific readiness) can be wired
+// in without changing the common controller.
+type NodeSelector interface {
+	// SelectNode returns the preferred node name out of candidates. It
+	// must return an error if candidates is empty.
+	SelectNode(candidates []string) (string, error)
+
+	// IsHealthy re-checks a single, previously chosen node. Callers that
+	// stick to a prior choice (see managedByNodeForContent) use this to
+	// detect health regressions - a node that was the best candidate at
+	// selection time but has since gone unhealthy - without having to
+	// re-run SelectNode's full fallback walk.
+	IsHealthy(node string) bool
+}
+
+// roundRobinNodeSelector is the default NodeSelector. It simply returns the
+// first candidate, which keeps the historical single-node behavior of
+// getManagedByNode for callers that do not care about failover.
+type roundRobinNodeSelector struct{}
+
+func (roundRobinNodeSelector) SelectNode(candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no candidate nodes to select from")
+	}
+	return candidates[0], nil
+}
+
+// IsHealthy always reports true: round-robin has no notion of node health,
+// so there is nothing for a sticky caller to regress away from.
+func (roundRobinNodeSelector) IsHealthy(node string) bool {
+	return true
+}
+
+// defaultNodeSelector is used whenever a controller is constructed without
+// an explicit NodeSelector.
+var defaultNodeSelector NodeSelector = roundRobinNodeSelector{}
+
+// getManagedByNode returns the name of a node whose labels satisfy the
+// given PersistentVolume's node affinity. When several nodes match, the
+// first one found is returned; use getManagedByNodes to retrieve every
+// match and choose among them, e.g. for replicated local volumes.
+func (ctrl *csiSnapshotCommonController) getManagedByNode(pv *v1.PersistentVolume) (string, error) {
+	nodes, err := ctrl.getManagedByNodes(pv)
+	if err != nil {
+		return "", err
+	}
+	if len(nodes) == 0 {
+		return "", nil
+	}
+	return nodes[0], nil
+}
+
+// getManagedByNodes returns every node whose labels satisfy the given
+// PersistentVolume's node affinity. For topologically pinned local or
+// replicated storage, a PV can legitimately be reachable from more than one
+// node, and callers that need to pick a healthy replica should use this
+// instead of getManagedByNode.
+func (ctrl *csiSnapshotCommonController) getManagedByNodes(pv *v1.PersistentVolume) ([]string, error) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil, nil
+	}
+
+	nodeList, err := ctrl.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, node := range nodeList {
+		match, err := corev1helpers.MatchNodeSelectorTerms(node, pv.Spec.NodeAffinity.Required)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matches = append(matches, node.Name)
+		}
+	}
+
+	return matches, nil
+}
+
+// selectManagedByNode returns the preferred node among every node matching
+// the PV's node affinity, using the controller's NodeSelector (or the
+// round-robin default if none was configured). Snapshot scheduling should
+// go through this rather than getManagedByNode so that a node whose CSI
+// sidecar is unhealthy is skipped in favor of a healthy replica.
+func (ctrl *csiSnapshotCommonController) selectManagedByNode(pv *v1.PersistentVolume) (string, error) {
+	nodes, err := ctrl.getManagedByNodes(pv)
+	if err != nil {
+		return "", err
+	}
+	if len(nodes) == 0 {
+		return "", nil
+	}
+
+	selector := ctrl.nodeSelector
+	if selector == nil {
+		selector = defaultNodeSelector
+	}
+	return selector.SelectNode(nodes)
+}
+
+// storeContentUpdate records a VolumeSnapshotContent watch/sync event in
+// ctrl.contentStore, respecting ctrl.cacheMode: under CacheModeMetadata
+// only its utils.SnapshotContentDigest is retained, keeping the informer
+// cache from holding the full object (Spec.Source, Status messages,
+// annotations, ...) that the controller's hot path never reads.
+func (ctrl *csiSnapshotCommonController) storeContentUpdate(content *crdv1.VolumeSnapshotContent) (bool, error) {
+	if ctrl.cacheMode == utils.CacheModeMetadata {
+		return utils.StoreObjectUpdate(ctrl.contentStore, utils.NewPrunedContent(content), "content")
+	}
+	return utils.StoreObjectUpdate(ctrl.contentStore, content, "content")
+}
+
+// managedByNodeForContent returns the node that should host the snapshot
+// operation for content's source PV, preferring the node recorded on
+// content from a previous attempt so that retries stay on the same node
+// instead of bouncing between healthy replicas on every resync. The
+// sticky node is re-validated on every call - both that it still matches
+// the PV's node affinity and, via the configured NodeSelector, that it is
+// still healthy - so a node that goes unhealthy after being chosen gets
+// replaced rather than stuck forever. The chosen node is (re-)recorded on
+// content's annotations so the caller can persist it.
+func (ctrl *csiSnapshotCommonController) managedByNodeForContent(content *crdv1.VolumeSnapshotContent, pv *v1.PersistentVolume) (string, error) {
+	if sticky, ok := content.Annotations[chosenManagedByNodeAnnotation]; ok && sticky != "" {
+		nodes, err := ctrl.getManagedByNodes(pv)
+		if err != nil {
+			return "", err
+		}
+		selector := ctrl.nodeSelector
+		if selector == nil {
+			selector = defaultNodeSelector
+		}
+		for _, n := range nodes {
+			if n == sticky && selector.IsHealthy(sticky) {
+				return sticky, nil
+			}
+		}
+		// Either the previously chosen node no longer matches the PV's
+		// affinity (e.g. it was removed from the cluster), or it's still a
+		// candidate but its health check now fails; fall through and pick
+		// again.
+	}
+
+	node, err := ctrl.selectManagedByNode(pv)
+	if err != nil {
+		return "", err
+	}
+	if node == "" {
+		return "", nil
+	}
+
+	if content.Annotations == nil {
+		content.Annotations = map[string]string{}
+	}
+	content.Annotations[chosenManagedByNodeAnnotation] = node
+	return node, nil
+}
+
+// runSnapshotLint runs ctrl.lintRegistry (if any) against pair and reports
+// the resulting violations as Events plus snapshot_lint_violations_total
+// metric increments. No sync loop in this package calls it; it lints
+// only the pairs it is handed. Linting never changes reconcile behavior,
+// it only surfaces what it finds.
+func (ctrl *csiSnapshotCommonController) runSnapshotLint(pair snapshotlint.Pair) {
+	if ctrl.lintRegistry == nil {
+		return
+	}
+	pair.Now = time.Now()
+
+	violations := ctrl.lintRegistry.Check(pair)
+	if len(violations) == 0 {
+		return
+	}
+
+	var reportOn snapshotlint.Object
+	var eventObj runtime.Object
+	switch {
+	case pair.Content != nil:
+		eventObj = pair.Content
+		reportOn = pair.Content
+	case pair.Snapshot != nil:
+		eventObj = pair.Snapshot
+		reportOn = pair.Snapshot
+	default:
+		return
+	}
+
+	snapshotlint.Report(ctrl.eventRecorder, eventObj, reportOn, violations, ctrl.lintSetInvalidCondition)
+}
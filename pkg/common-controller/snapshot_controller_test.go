@@ -17,14 +17,19 @@ limitations under the License.
 package common_controller
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	"github.com/kubernetes-csi/external-snapshotter/v6/pkg/snapshotlint"
 	"github.com/kubernetes-csi/external-snapshotter/v6/pkg/utils"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 var deletionPolicy = crdv1.VolumeSnapshotContentDelete
@@ -43,6 +48,33 @@ func (l FakeNodeLister) Get(name string) (*v1.Node, error) {
 	return nil, nil
 }
 
+// FakeCSINodeLister backs healthAwareNodeSelector in tests: a node is
+// considered to have a healthy driver if its name has an entry in
+// HealthyDrivers mapping to driverName.
+type FakeCSINodeLister struct {
+	// HealthyDrivers maps node name -> driver name installed on that node.
+	HealthyDrivers map[string]string
+}
+
+func (l FakeCSINodeLister) List(selector labels.Selector) (ret []*storagev1.CSINode, err error) {
+	return nil, nil
+}
+
+func (l FakeCSINodeLister) Get(name string) (*storagev1.CSINode, error) {
+	driver, ok := l.HealthyDrivers[name]
+	if !ok {
+		return nil, fmt.Errorf("csinode %q not found", name)
+	}
+	return &storagev1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.CSINodeSpec{
+			Drivers: []storagev1.CSINodeDriver{
+				{Name: driver, NodeID: name},
+			},
+		},
+	}, nil
+}
+
 func storeVersion(t *testing.T, prefix string, c cache.Store, version string, expectedReturn bool) {
 	content := newContent("contentName", "snapuid1-1", "snap1-1", "sid1-1", classGold, "", "pv-handle-1-1", deletionPolicy, nil, nil, false, true)
 	content.ResourceVersion = version
@@ -110,6 +142,66 @@ func TestControllerCacheParsingError(t *testing.T) {
 	}
 }
 
+// storePrunedVersion mirrors storeVersion, but against a CacheModeMetadata
+// store holding *utils.PrunedContent instead of the full content object.
+func storePrunedVersion(t *testing.T, prefix string, c cache.Store, version string, expectedReturn bool) {
+	content := newContent("contentName", "snapuid1-1", "snap1-1", "sid1-1", classGold, "", "pv-handle-1-1", deletionPolicy, nil, nil, false, true)
+	content.ResourceVersion = version
+	ret, err := utils.StoreObjectUpdate(c, utils.NewPrunedContent(content), "content")
+	if err != nil {
+		t.Errorf("%s: expected storeObjectUpdate to succeed, got: %v", prefix, err)
+	}
+	if expectedReturn != ret {
+		t.Errorf("%s: expected storeObjectUpdate to return %v, got: %v", prefix, expectedReturn, ret)
+	}
+
+	obj, found, err := c.GetByKey("contentName")
+	if err != nil {
+		t.Errorf("expected content 'contentName' in the cache, got error instead: %v", err)
+	}
+	if !found {
+		t.Errorf("expected content 'contentName' in the cache but it was not found")
+	}
+	pruned, ok := obj.(*utils.PrunedContent)
+	if !ok {
+		t.Errorf("expected *utils.PrunedContent in the cache, got different object instead: %#v", obj)
+	}
+
+	if ret {
+		if pruned.ResourceVersion != version {
+			t.Errorf("expected content with version %s in the cache, got %s instead", version, pruned.ResourceVersion)
+		}
+	} else {
+		if pruned.ResourceVersion == version {
+			t.Errorf("expected content with version other than %s in the cache, got %s instead", version, pruned.ResourceVersion)
+		}
+	}
+}
+
+// TestControllerCacheMetadataMode repeats TestControllerCache's version-skew
+// scenarios against a CacheModeMetadata store to show the pruned cache
+// preserves the same stale/accept semantics as the full-object cache.
+func TestControllerCacheMetadataMode(t *testing.T) {
+	c := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+
+	storePrunedVersion(t, "Step1", c, "1", true)
+	storePrunedVersion(t, "Step2", c, "1", true)
+	storePrunedVersion(t, "Step3", c, "2", true)
+	storePrunedVersion(t, "Step4", c, "1", false)
+	storePrunedVersion(t, "Step5", c, "10", true)
+}
+
+func TestControllerCacheParsingErrorMetadataMode(t *testing.T) {
+	c := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+	storePrunedVersion(t, "Step1", c, "1", true)
+	content := newContent("contentName", "snapuid1-1", "snap1-1", "sid1-1", classGold, "", "pv-handle-1-1", deletionPolicy, nil, nil, false, true)
+	content.ResourceVersion = "xxx"
+	_, err := utils.StoreObjectUpdate(c, utils.NewPrunedContent(content), "content")
+	if err == nil {
+		t.Errorf("Expected parsing error, got nil instead")
+	}
+}
+
 func TestGetManagedByNode(t *testing.T) {
 
 	// Test that a matching node is found
@@ -177,3 +269,282 @@ func TestGetManagedByNode(t *testing.T) {
 		t.Errorf("Expected no node, Found node(%s)", nodeName)
 	}
 }
+
+func TestGetManagedByNodes(t *testing.T) {
+	node1 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"key1": "value1"}}}
+	node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"key1": "value1"}}}
+	node3 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{"key1": "other"}}}
+
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "key1", Operator: v1.NodeSelectorOpIn, Values: []string{"value1"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Multiple nodes match: both replicas come back, in list order.
+	ctrl := &csiSnapshotCommonController{
+		nodeLister: FakeNodeLister{NodeList: []*v1.Node{node1, node2, node3}},
+	}
+	nodes, err := ctrl.getManagedByNodes(pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0] != "node1" || nodes[1] != "node2" {
+		t.Errorf("expected [node1 node2], got %v", nodes)
+	}
+
+	// No node matches: empty, no error.
+	ctrl = &csiSnapshotCommonController{
+		nodeLister: FakeNodeLister{NodeList: []*v1.Node{node3}},
+	}
+	nodes, err = ctrl.getManagedByNodes(pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("expected no matching nodes, got %v", nodes)
+	}
+}
+
+func TestSelectManagedByNodeFailover(t *testing.T) {
+	node1 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"key1": "value1"}}}
+	node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"key1": "value1"}}}
+
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "key1", Operator: v1.NodeSelectorOpIn, Values: []string{"value1"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// node1's CSINode has no driver registered; node2's does. The selector
+	// should skip node1 and fail over to node2.
+	ctrl := &csiSnapshotCommonController{
+		nodeLister: FakeNodeLister{NodeList: []*v1.Node{node1, node2}},
+		nodeSelector: NewHealthAwareNodeSelector(
+			FakeCSINodeLister{HealthyDrivers: map[string]string{"node2": "fake.csi.driver"}},
+			"fake.csi.driver",
+		),
+	}
+
+	node, err := ctrl.selectManagedByNode(pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node2" {
+		t.Errorf("expected failover to node2, got %q", node)
+	}
+
+	// Neither node reports the driver: selector falls back to the first
+	// candidate rather than returning an error.
+	ctrl.nodeSelector = NewHealthAwareNodeSelector(FakeCSINodeLister{HealthyDrivers: map[string]string{}}, "fake.csi.driver")
+	node, err = ctrl.selectManagedByNode(pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node1" {
+		t.Errorf("expected fallback to node1, got %q", node)
+	}
+}
+
+func TestManagedByNodeForContent(t *testing.T) {
+	node1 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"key1": "value1"}}}
+	node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"key1": "value1"}}}
+
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "key1", Operator: v1.NodeSelectorOpIn, Values: []string{"value1"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	ctrl := &csiSnapshotCommonController{
+		nodeLister: FakeNodeLister{NodeList: []*v1.Node{node1, node2}},
+	}
+
+	content := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}}
+
+	// First call picks the first candidate and records it.
+	node, err := ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node1" {
+		t.Fatalf("expected node1, got %q", node)
+	}
+	if got := content.Annotations[chosenManagedByNodeAnnotation]; got != "node1" {
+		t.Errorf("expected chosen node annotation to be node1, got %q", got)
+	}
+
+	// A retry (simulating a resync before the operation finished) must
+	// stick to the same node rather than re-running the selector.
+	node, err = ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node1" {
+		t.Errorf("expected retry to stay on node1, got %q", node)
+	}
+
+	// If the previously chosen node disappears from the candidate set
+	// (e.g. removed from the cluster), fall back to picking again.
+	ctrl.nodeLister = FakeNodeLister{NodeList: []*v1.Node{node2}}
+	node, err = ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node2" {
+		t.Errorf("expected fallback to node2 once node1 disappeared, got %q", node)
+	}
+	if got := content.Annotations[chosenManagedByNodeAnnotation]; got != "node2" {
+		t.Errorf("expected chosen node annotation to be updated to node2, got %q", got)
+	}
+}
+
+func TestManagedByNodeForContentHealthRegression(t *testing.T) {
+	node1 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"key1": "value1"}}}
+	node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"key1": "value1"}}}
+
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{Key: "key1", Operator: v1.NodeSelectorOpIn, Values: []string{"value1"}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Neither replica is healthy at first sync: selectManagedByNode falls
+	// back to the first candidate, which becomes the sticky choice.
+	healthyDrivers := map[string]string{}
+	ctrl := &csiSnapshotCommonController{
+		nodeLister:   FakeNodeLister{NodeList: []*v1.Node{node1, node2}},
+		nodeSelector: NewHealthAwareNodeSelector(FakeCSINodeLister{HealthyDrivers: healthyDrivers}, "fake.csi.driver"),
+	}
+	content := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}}
+
+	node, err := ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node1" {
+		t.Fatalf("expected fallback choice node1, got %q", node)
+	}
+
+	// node1 stays unhealthy but node2 becomes healthy: a resync must not
+	// return node1 forever just because it's still topologically valid -
+	// it should notice the health regression and move to node2.
+	healthyDrivers["node2"] = "fake.csi.driver"
+	node, err = ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node2" {
+		t.Errorf("expected re-selection to move off the now-unhealthy sticky node1 to node2, got %q", node)
+	}
+	if got := content.Annotations[chosenManagedByNodeAnnotation]; got != "node2" {
+		t.Errorf("expected chosen node annotation to be updated to node2, got %q", got)
+	}
+
+	// Once node1 becomes healthy again, subsequent retries may keep
+	// node2 (the sticky node is still healthy, so it isn't abandoned just
+	// because a different node also became healthy).
+	healthyDrivers["node1"] = "fake.csi.driver"
+	node, err = ctrl.managedByNodeForContent(content, pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node != "node2" {
+		t.Errorf("expected sticky node2 to be kept once it's healthy, got %q", node)
+	}
+}
+
+func TestRunSnapshotLint(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	content := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}}
+
+	ctrl := &csiSnapshotCommonController{
+		lintRegistry:            snapshotlint.NewRegistry(),
+		lintSetInvalidCondition: true,
+		eventRecorder:           recorder,
+	}
+
+	// A dangling content (no bound snapshot) should produce an Event on
+	// the content and, because lintSetInvalidCondition is set and
+	// DanglingContent is Warning-severity only, no Invalid annotation.
+	ctrl.runSnapshotLint(snapshotlint.Pair{Content: content})
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "DanglingContent") {
+			t.Errorf("expected a DanglingContent event, got %q", event)
+		}
+	default:
+		t.Errorf("expected an Event to be recorded for the dangling content")
+	}
+	if _, ok := content.Annotations["snapshot.storage.kubernetes.io/invalid"]; ok {
+		t.Errorf("did not expect the Invalid annotation for a Warning-only violation")
+	}
+
+	// A content with a mismatched driver (Error severity) should also set
+	// the Invalid annotation.
+	mismatched := &crdv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-2"},
+		Spec:       crdv1.VolumeSnapshotContentSpec{Driver: "driver-a"},
+	}
+	ctrl.runSnapshotLint(snapshotlint.Pair{
+		Content: mismatched,
+		Class:   &crdv1.VolumeSnapshotClass{Driver: "driver-b"},
+	})
+	if got := mismatched.Annotations["snapshot.storage.kubernetes.io/invalid"]; got != "true" {
+		t.Errorf("expected the Invalid annotation to be set for a MismatchedDriver violation, got %q", got)
+	}
+
+	// A nil registry disables linting entirely: no Event, no annotation.
+	// A fresh recorder keeps the previous step's Events out of this check.
+	recorder = record.NewFakeRecorder(10)
+	ctrl.eventRecorder = recorder
+	ctrl.lintRegistry = nil
+	clean := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-3"}}
+	ctrl.runSnapshotLint(snapshotlint.Pair{Content: clean})
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected no Event with a nil lint registry, got %q", event)
+	default:
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package snapshotlint runs a set of opt-in sanity checks against
+// VolumeSnapshot/VolumeSnapshotContent pairs, surfacing problems (dangling
+// content, a class that no longer exists, a mismatched driver, ...) that
+// the controller's reconcile loop would otherwise leave to be noticed only
+// when an operator goes looking for them.
+package snapshotlint
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+)
+
+// Severity classifies how urgently a Violation should be treated.
+type Severity string
+
+const (
+	// SeverityWarning marks a condition that is worth an operator's
+	// attention but does not, by itself, indicate data loss or a stuck
+	// resource.
+	SeverityWarning Severity = "Warning"
+
+	// SeverityError marks a condition that likely needs operator
+	// intervention, e.g. an orphaned handle or a resource stuck past its
+	// expected lifetime.
+	SeverityError Severity = "Error"
+)
+
+// Pair bundles a VolumeSnapshot with its bound VolumeSnapshotContent (and
+// the VolumeSnapshotClass either names, if it still exists) so that Rules
+// can check cross-object invariants without each re-deriving the
+// relationship. Either Snapshot or Content may be nil: a Rule that cares
+// about dangling objects must handle the pair being partial.
+type Pair struct {
+	Snapshot *crdv1.VolumeSnapshot
+	Content  *crdv1.VolumeSnapshotContent
+	Class    *crdv1.VolumeSnapshotClass
+
+	// SourcePVCMissing is true when Snapshot's source PersistentVolumeClaim
+	// no longer exists. The caller (which has access to the PVC lister)
+	// is expected to fill this in; Rules never look PVCs up themselves.
+	SourcePVCMissing bool
+
+	// Now is the time the caller considers "current". Rules that care
+	// about elapsed time (e.g. RuleStuckNotReady) compare against this
+	// instead of calling time.Now() so that they stay deterministic in
+	// tests.
+	Now time.Time
+}
+
+// Violation is one Rule's finding against a Pair.
+type Violation struct {
+	// Code is a short, stable, machine-readable identifier for the rule
+	// that produced this violation, e.g. "DanglingContent". It is what
+	// operators use to disable a rule via Registry.Disable and what's
+	// attached to the snapshot_lint_violations_total metric.
+	Code     string
+	Severity Severity
+	// Message is a human-readable description suitable for a Kubernetes
+	// Event or log line.
+	Message string
+}
+
+// Rule checks one invariant against a Pair. A Rule should be read-only: it
+// reports violations, it never mutates the objects it's given.
+type Rule interface {
+	// Code is the stable identifier for this rule (see Violation.Code).
+	Code() string
+	// Check returns the violations found in pair, or nil if none.
+	Check(pair Pair) []Violation
+}
+
+// Registry holds the set of Rules that should run, letting operators
+// disable individual rules by Code (e.g. because a rule doesn't apply to
+// their driver, or is too noisy for their environment).
+type Registry struct {
+	rules    []Rule
+	disabled map[string]bool
+}
+
+// NewRegistry returns a Registry running every rule in DefaultRules.
+func NewRegistry() *Registry {
+	return &Registry{
+		rules:    append([]Rule(nil), DefaultRules()...),
+		disabled: map[string]bool{},
+	}
+}
+
+// Disable turns off the rule with the given code. Disabling an unknown
+// code is a no-op: it's not an error to disable a rule that was already
+// removed, or that never existed in this build.
+func (r *Registry) Disable(code string) {
+	r.disabled[code] = true
+}
+
+// Enable re-enables a previously disabled rule.
+func (r *Registry) Enable(code string) {
+	delete(r.disabled, code)
+}
+
+// Check runs every enabled rule against pair and returns the combined,
+// Code-sorted list of violations.
+func (r *Registry) Check(pair Pair) []Violation {
+	var violations []Violation
+	for _, rule := range r.rules {
+		if r.disabled[rule.Code()] {
+			continue
+		}
+		violations = append(violations, rule.Check(pair)...)
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].Code < violations[j].Code
+	})
+	return violations
+}
+
+// objectName is a small helper shared by the Rule implementations for
+// building Messages; it's not exported because Rules are expected to live
+// in this package.
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
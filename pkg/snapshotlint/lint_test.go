@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshotlint
+
+import (
+	"testing"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func strPtr(s string) *string { return &s }
+func boolPtr(b bool) *bool    { return &b }
+
+func TestRuleDanglingContent(t *testing.T) {
+	tests := map[string]struct {
+		pair      Pair
+		wantCodes []string
+	}{
+		"dangling content": {
+			pair:      Pair{Content: &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}}},
+			wantCodes: []string{"DanglingContent"},
+		},
+		"bound content is fine": {
+			pair: Pair{
+				Content:  &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}},
+				Snapshot: &crdv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "snap-1"}},
+			},
+			wantCodes: nil,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := RuleDanglingContent{}.Check(tc.pair)
+			assertCodes(t, got, tc.wantCodes)
+		})
+	}
+}
+
+func TestRuleMissingClass(t *testing.T) {
+	snap := &crdv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{Name: "snap-1"},
+		Spec:       crdv1.VolumeSnapshotSpec{VolumeSnapshotClassName: strPtr("gold")},
+	}
+
+	got := RuleMissingClass{}.Check(Pair{Snapshot: snap})
+	assertCodes(t, got, []string{"MissingClass"})
+
+	got = RuleMissingClass{}.Check(Pair{Snapshot: snap, Class: &crdv1.VolumeSnapshotClass{}})
+	assertCodes(t, got, nil)
+}
+
+func TestRuleOrphanedRetainedHandle(t *testing.T) {
+	content := &crdv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1"},
+		Spec: crdv1.VolumeSnapshotContentSpec{
+			DeletionPolicy: crdv1.VolumeSnapshotContentRetain,
+			Source:         crdv1.VolumeSnapshotContentSource{SnapshotHandle: strPtr("handle-1")},
+		},
+	}
+
+	// Source PVC still present: not orphaned yet.
+	got := RuleOrphanedRetainedHandle{}.Check(Pair{Content: content, SourcePVCMissing: false})
+	assertCodes(t, got, nil)
+
+	// Source PVC gone, no bound snapshot, Retain: orphaned.
+	got = RuleOrphanedRetainedHandle{}.Check(Pair{Content: content, SourcePVCMissing: true})
+	assertCodes(t, got, []string{"OrphanedRetainedHandle"})
+
+	// Delete policy means the handle is expected to go away on its own.
+	deleteContent := content.DeepCopy()
+	deleteContent.Spec.DeletionPolicy = crdv1.VolumeSnapshotContentDelete
+	got = RuleOrphanedRetainedHandle{}.Check(Pair{Content: deleteContent, SourcePVCMissing: true})
+	assertCodes(t, got, nil)
+}
+
+func TestRuleMismatchedDriver(t *testing.T) {
+	content := &crdv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1"},
+		Spec:       crdv1.VolumeSnapshotContentSpec{Driver: "driver-a"},
+	}
+
+	got := RuleMismatchedDriver{}.Check(Pair{Content: content, Class: &crdv1.VolumeSnapshotClass{Driver: "driver-a"}})
+	assertCodes(t, got, nil)
+
+	got = RuleMismatchedDriver{}.Check(Pair{Content: content, Class: &crdv1.VolumeSnapshotClass{Driver: "driver-b"}})
+	assertCodes(t, got, []string{"MismatchedDriver"})
+}
+
+func TestRuleStuckNotReady(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	rule := NewRuleStuckNotReady(10 * time.Minute)
+
+	freshContent := &crdv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1", CreationTimestamp: metav1.NewTime(now.Add(-time.Minute))},
+	}
+	got := rule.Check(Pair{Content: freshContent, Now: now})
+	assertCodes(t, got, nil)
+
+	staleContent := &crdv1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1", CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))},
+	}
+	got = rule.Check(Pair{Content: staleContent, Now: now})
+	assertCodes(t, got, []string{"StuckNotReady"})
+
+	readyContent := staleContent.DeepCopy()
+	readyContent.Status = &crdv1.VolumeSnapshotContentStatus{ReadyToUse: boolPtr(true)}
+	got = rule.Check(Pair{Content: readyContent, Now: now})
+	assertCodes(t, got, nil)
+}
+
+func TestRegistryDisable(t *testing.T) {
+	r := NewRegistry()
+	pair := Pair{Content: &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1"}}}
+
+	got := r.Check(pair)
+	assertCodes(t, got, []string{"DanglingContent"})
+
+	r.Disable("DanglingContent")
+	got = r.Check(pair)
+	assertCodes(t, got, nil)
+
+	r.Enable("DanglingContent")
+	got = r.Check(pair)
+	assertCodes(t, got, []string{"DanglingContent"})
+}
+
+func assertCodes(t *testing.T, got []Violation, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected codes %v, got %v", want, got)
+	}
+	for i, v := range got {
+		if v.Code != want[i] {
+			t.Errorf("expected code %q at index %d, got %q", want[i], i, v.Code)
+		}
+	}
+}
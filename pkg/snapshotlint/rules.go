@@ -0,0 +1,180 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshotlint
+
+import (
+	"fmt"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+)
+
+// DefaultRules returns one instance of every built-in Rule, in the order
+// NewRegistry runs them. NewRegistry always uses these rules, so its
+// RuleStuckNotReady threshold is defaultStuckNotReadyThreshold; this
+// package has no constructor for a Registry with other rules or another
+// threshold.
+func DefaultRules() []Rule {
+	return []Rule{
+		RuleDanglingContent{},
+		RuleMissingClass{},
+		RuleOrphanedRetainedHandle{},
+		RuleMismatchedDriver{},
+		NewRuleStuckNotReady(defaultStuckNotReadyThreshold),
+	}
+}
+
+const defaultStuckNotReadyThreshold = 10 * time.Minute
+
+// RuleDanglingContent flags a VolumeSnapshotContent that is bound to no
+// VolumeSnapshot. A content object is created by a snapshot request and
+// should always be referenced by one; a dangling content is either a
+// leftover from a deleted snapshot that failed to clean up, or evidence
+// the two caches have drifted.
+type RuleDanglingContent struct{}
+
+func (RuleDanglingContent) Code() string { return "DanglingContent" }
+
+func (RuleDanglingContent) Check(pair Pair) []Violation {
+	if pair.Content == nil || pair.Snapshot != nil {
+		return nil
+	}
+	return []Violation{{
+		Code:     "DanglingContent",
+		Severity: SeverityWarning,
+		Message:  fmt.Sprintf("VolumeSnapshotContent %s has no VolumeSnapshot bound to it", pair.Content.Name),
+	}}
+}
+
+// RuleMissingClass flags a VolumeSnapshot that names a VolumeSnapshotClass
+// which no longer exists. Without its class, a pending snapshot can never
+// be provisioned.
+type RuleMissingClass struct{}
+
+func (RuleMissingClass) Code() string { return "MissingClass" }
+
+func (RuleMissingClass) Check(pair Pair) []Violation {
+	if pair.Snapshot == nil || pair.Class != nil {
+		return nil
+	}
+	className := pair.Snapshot.Spec.VolumeSnapshotClassName
+	if className == nil || *className == "" {
+		return nil
+	}
+	return []Violation{{
+		Code:     "MissingClass",
+		Severity: SeverityError,
+		Message:  fmt.Sprintf("VolumeSnapshot %s references VolumeSnapshotClass %q which does not exist", objectName(pair.Snapshot.Namespace, pair.Snapshot.Name), *className),
+	}}
+}
+
+// RuleOrphanedRetainedHandle flags a VolumeSnapshotContent whose
+// DeletionPolicy is Retain, whose source PersistentVolumeClaim is gone
+// (SourcePVCMissing), and whose snapshot has also been deleted
+// (pair.Snapshot == nil). Retain means the storage-side snapshot handle
+// outlives the Kubernetes objects by design, but once nothing in the
+// cluster references it any more, it's effectively orphaned: nothing will
+// ever clean it up, and an operator should be told it exists.
+type RuleOrphanedRetainedHandle struct{}
+
+func (RuleOrphanedRetainedHandle) Code() string { return "OrphanedRetainedHandle" }
+
+func (RuleOrphanedRetainedHandle) Check(pair Pair) []Violation {
+	if pair.Content == nil || pair.Snapshot != nil {
+		return nil
+	}
+	if pair.Content.Spec.DeletionPolicy != crdv1.VolumeSnapshotContentRetain {
+		return nil
+	}
+	if !pair.SourcePVCMissing {
+		return nil
+	}
+	handle := ""
+	if pair.Content.Spec.Source.SnapshotHandle != nil {
+		handle = *pair.Content.Spec.Source.SnapshotHandle
+	}
+	return []Violation{{
+		Code:     "OrphanedRetainedHandle",
+		Severity: SeverityError,
+		Message:  fmt.Sprintf("VolumeSnapshotContent %s has DeletionPolicy=Retain, no bound VolumeSnapshot and a missing source PVC; handle %q is now orphaned", pair.Content.Name, handle),
+	}}
+}
+
+// RuleMismatchedDriver flags a VolumeSnapshotContent whose Spec.Driver
+// doesn't match the Driver of its own VolumeSnapshotClass. This can only
+// happen if the class was edited after the content was provisioned, but
+// when it does, every later operation against the content will be routed
+// to the wrong CSI driver.
+type RuleMismatchedDriver struct{}
+
+func (RuleMismatchedDriver) Code() string { return "MismatchedDriver" }
+
+func (RuleMismatchedDriver) Check(pair Pair) []Violation {
+	if pair.Content == nil || pair.Class == nil {
+		return nil
+	}
+	if pair.Content.Spec.Driver == pair.Class.Driver {
+		return nil
+	}
+	return []Violation{{
+		Code:     "MismatchedDriver",
+		Severity: SeverityError,
+		Message: fmt.Sprintf("VolumeSnapshotContent %s has driver %q but its VolumeSnapshotClass has driver %q",
+			pair.Content.Name, pair.Content.Spec.Driver, pair.Class.Driver),
+	}}
+}
+
+// RuleStuckNotReady flags a VolumeSnapshotContent that has been
+// non-ready for longer than Threshold. A content without a
+// CreationTimestamp, or a Pair without Now, is not checked. A content usually transitions to
+// ready quickly; one stuck for an extended period typically indicates the
+// CSI driver is failing the CreateSnapshot call, or that a sidecar is
+// down.
+type RuleStuckNotReady struct {
+	Threshold time.Duration
+}
+
+// NewRuleStuckNotReady returns a RuleStuckNotReady using threshold as the
+// cutoff for how long a content may stay non-ready before it's flagged.
+func NewRuleStuckNotReady(threshold time.Duration) RuleStuckNotReady {
+	return RuleStuckNotReady{Threshold: threshold}
+}
+
+func (RuleStuckNotReady) Code() string { return "StuckNotReady" }
+
+func (r RuleStuckNotReady) Check(pair Pair) []Violation {
+	if pair.Content == nil {
+		return nil
+	}
+	status := pair.Content.Status
+	if status != nil && status.ReadyToUse != nil && *status.ReadyToUse {
+		return nil
+	}
+	now := pair.Now
+	if now.IsZero() || pair.Content.CreationTimestamp.IsZero() {
+		return nil
+	}
+	age := now.Sub(pair.Content.CreationTimestamp.Time)
+	if age < r.Threshold {
+		return nil
+	}
+	return []Violation{{
+		Code:     "StuckNotReady",
+		Severity: SeverityError,
+		Message:  fmt.Sprintf("VolumeSnapshotContent %s has been non-ready for %s, past the %s threshold", pair.Content.Name, age.Round(time.Second), r.Threshold),
+	}}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CacheMode selects what a controller's VolumeSnapshotContent informer
+// stores in its shared cache.
+type CacheMode string
+
+const (
+	// CacheModeFull stores the complete VolumeSnapshotContent object, as
+	// the controller has always done. Use this unless memory footprint of
+	// the informer cache is a concern.
+	CacheModeFull CacheMode = "Full"
+
+	// CacheModeMetadata stores only ObjectMeta plus a SnapshotContentDigest
+	// for each VolumeSnapshotContent. Most fields of a content object
+	// (Spec.Source, long Status messages, annotations) are never read on
+	// the controller's hot path, so a cluster with many large snapshots
+	// can shrink the controller's RSS substantially by not holding full
+	// copies in the informer cache. Callers that need the full object fetch
+	// it on demand (see PrunedContentStore).
+	CacheModeMetadata CacheMode = "Metadata"
+)
+
+// SnapshotContentDigest holds the handful of VolumeSnapshotContent fields
+// the common controller actually consults while reconciling, so that a
+// CacheModeMetadata informer does not need to retain the full object.
+type SnapshotContentDigest struct {
+	Driver                 string
+	SnapshotHandle         string
+	ReadyToUse             bool
+	DeletionPolicy         crdv1.DeletionPolicy
+	BoundVolumeSnapshotRef *v1.ObjectReference
+	ResourceVersion        string
+}
+
+// NewSnapshotContentDigest extracts a SnapshotContentDigest from a full
+// VolumeSnapshotContent. The digest holds its own copy of every field -
+// in particular BoundVolumeSnapshotRef is copied by value rather than
+// pointing into content.Spec, since a pointer into the full object would
+// keep the whole VolumeSnapshotContent (Status, Spec.Source, ...) alive
+// for as long as the digest sits in the informer cache, defeating the
+// point of CacheModeMetadata.
+func NewSnapshotContentDigest(content *crdv1.VolumeSnapshotContent) SnapshotContentDigest {
+	ref := content.Spec.VolumeSnapshotRef
+	digest := SnapshotContentDigest{
+		Driver:                 content.Spec.Driver,
+		DeletionPolicy:         content.Spec.DeletionPolicy,
+		BoundVolumeSnapshotRef: &ref,
+		ResourceVersion:        content.ResourceVersion,
+	}
+	if content.Spec.Source.SnapshotHandle != nil {
+		digest.SnapshotHandle = *content.Spec.Source.SnapshotHandle
+	}
+	if content.Status != nil && content.Status.ReadyToUse != nil {
+		digest.ReadyToUse = *content.Status.ReadyToUse
+	}
+	return digest
+}
+
+// PrunedContent is what a CacheModeMetadata informer stores in place of a
+// full VolumeSnapshotContent: just enough to satisfy cache.Store (which
+// needs a metav1.Object to compute keys and compare ResourceVersions) plus
+// the digest of fields the controller actually reads.
+type PrunedContent struct {
+	metav1.ObjectMeta
+	Digest SnapshotContentDigest
+}
+
+// NewPrunedContent builds the PrunedContent that should be stored in a
+// CacheModeMetadata informer for the given full VolumeSnapshotContent.
+// Only Name/Namespace/ResourceVersion are copied into ObjectMeta - that's
+// all cache.Store needs for key computation and version comparison. A
+// full (or even a deep-copied) ObjectMeta would carry Annotations,
+// Labels, OwnerReferences and ManagedFields into the cache, which is
+// exactly the per-object bulk CacheModeMetadata exists to avoid holding.
+func NewPrunedContent(content *crdv1.VolumeSnapshotContent) *PrunedContent {
+	return &PrunedContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            content.Name,
+			Namespace:       content.Namespace,
+			ResourceVersion: content.ResourceVersion,
+		},
+		Digest: NewSnapshotContentDigest(content),
+	}
+}
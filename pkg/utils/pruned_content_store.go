@@ -0,0 +1,88 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	apimachinerycache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ContentFetcher retrieves the full VolumeSnapshotContent for name, e.g.
+// via the typed clientset. It is called only on a cache miss, i.e. when
+// CacheModeMetadata is in use and a full object wasn't already in the LRU.
+type ContentFetcher func(name string) (*crdv1.VolumeSnapshotContent, error)
+
+// PrunedContentStore is a cache.Store of *PrunedContent (see
+// CacheModeMetadata) that also knows how to recover the full
+// VolumeSnapshotContent on demand, keeping a small number of recently used
+// full objects in an LRU so that a hot VolumeSnapshotContent doesn't pay
+// the round trip to the API server on every reconcile.
+type PrunedContentStore struct {
+	cache.Store
+	fetch ContentFetcher
+	full  *apimachinerycache.LRUExpireCache
+	ttl   time.Duration
+}
+
+// NewPrunedContentStore builds a PrunedContentStore backed by a plain
+// cache.Store of digests and an LRU of at most lruSize full objects, each
+// retained for at most ttl before being re-fetched.
+func NewPrunedContentStore(fetch ContentFetcher, lruSize int, ttl time.Duration) *PrunedContentStore {
+	return &PrunedContentStore{
+		Store: cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		fetch: fetch,
+		full:  apimachinerycache.NewLRUExpireCache(lruSize),
+		ttl:   ttl,
+	}
+}
+
+// GetContent returns the full VolumeSnapshotContent named name. It is
+// served from the LRU when possible; otherwise it is fetched and the LRU
+// is populated. Returns an error if name isn't present in the digest
+// cache at all (i.e. the informer has no record of such an object).
+func (s *PrunedContentStore) GetContent(name string) (*crdv1.VolumeSnapshotContent, error) {
+	obj, found, err := s.Store.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("volumesnapshotcontent %q not found", name)
+	}
+	pruned, ok := obj.(*PrunedContent)
+	if !ok {
+		return nil, fmt.Errorf("volumesnapshotcontent %q in pruned cache has unexpected type %T", name, obj)
+	}
+
+	if cached, ok := s.full.Get(name); ok {
+		if content, ok := cached.(*crdv1.VolumeSnapshotContent); ok && content.ResourceVersion == pruned.ResourceVersion {
+			return content, nil
+		}
+		// Stale: the digest has moved on since this was cached.
+		s.full.Remove(name)
+	}
+
+	content, err := s.fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	s.full.Add(name, content, s.ttl)
+	return content, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	crdv1 "github.com/kubernetes-csi/external-snapshotter/client/v6/apis/volumesnapshot/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPrunedContentStoreNotFound(t *testing.T) {
+	s := NewPrunedContentStore(func(name string) (*crdv1.VolumeSnapshotContent, error) {
+		t.Fatalf("fetch should not be called for a name the digest cache has never seen")
+		return nil, nil
+	}, 4, time.Minute)
+
+	if _, err := s.GetContent("does-not-exist"); err == nil {
+		t.Errorf("expected an error for a name absent from the digest cache, got nil")
+	}
+}
+
+func TestPrunedContentStoreFetchOnMissThenLRUHit(t *testing.T) {
+	fetches := 0
+	content := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1", ResourceVersion: "5"}}
+
+	s := NewPrunedContentStore(func(name string) (*crdv1.VolumeSnapshotContent, error) {
+		fetches++
+		return content, nil
+	}, 4, time.Minute)
+	if err := s.Store.Add(NewPrunedContent(content)); err != nil {
+		t.Fatalf("unexpected error priming digest cache: %v", err)
+	}
+
+	got, err := s.GetContent("content-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != content {
+		t.Errorf("expected the fetched content back, got %#v", got)
+	}
+	if fetches != 1 {
+		t.Errorf("expected exactly one fetch on cache miss, got %d", fetches)
+	}
+
+	// Second call should be served from the LRU without fetching again.
+	if _, err := s.GetContent("content-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("expected the LRU hit to avoid a second fetch, got %d fetches", fetches)
+	}
+}
+
+func TestPrunedContentStoreStaleLRUEntryIsRefetched(t *testing.T) {
+	fetches := 0
+	v5 := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1", ResourceVersion: "5"}}
+	v6 := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1", ResourceVersion: "6"}}
+
+	current := v5
+	s := NewPrunedContentStore(func(name string) (*crdv1.VolumeSnapshotContent, error) {
+		fetches++
+		return current, nil
+	}, 4, time.Minute)
+	if err := s.Store.Add(NewPrunedContent(v5)); err != nil {
+		t.Fatalf("unexpected error priming digest cache: %v", err)
+	}
+
+	if _, err := s.GetContent("content-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected one fetch to populate the LRU, got %d", fetches)
+	}
+
+	// The digest cache (the informer, in a real controller) moves on to a
+	// newer ResourceVersion; the LRU entry for "5" must be treated as
+	// stale rather than served.
+	current = v6
+	if err := s.Store.Update(NewPrunedContent(v6)); err != nil {
+		t.Fatalf("unexpected error updating digest cache: %v", err)
+	}
+
+	got, err := s.GetContent("content-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.ResourceVersion != "6" {
+		t.Errorf("expected refreshed content at ResourceVersion 6, got %s", got.ResourceVersion)
+	}
+	if fetches != 2 {
+		t.Errorf("expected the stale LRU entry to trigger a second fetch, got %d fetches", fetches)
+	}
+}
+
+func TestPrunedContentStoreFetchError(t *testing.T) {
+	content := &crdv1.VolumeSnapshotContent{ObjectMeta: metav1.ObjectMeta{Name: "content-1", ResourceVersion: "5"}}
+	s := NewPrunedContentStore(func(name string) (*crdv1.VolumeSnapshotContent, error) {
+		return nil, fmt.Errorf("injected fetch error")
+	}, 4, time.Minute)
+	if err := s.Store.Add(NewPrunedContent(content)); err != nil {
+		t.Fatalf("unexpected error priming digest cache: %v", err)
+	}
+
+	if _, err := s.GetContent("content-1"); err == nil {
+		t.Errorf("expected the fetch error to surface, got nil")
+	}
+}
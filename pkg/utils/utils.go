@@ -0,0 +1,97 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package utils holds helpers shared between the common controller and the
+// sidecar controllers, such as the shared-informer cache bookkeeping used
+// to ignore stale watch events.
+package utils
+
+import (
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// StoreObjectUpdate updates given cache with a new object version from
+// Informer callback (i.e. with events from etcd) or with an object
+// modified by the controller itself. Returns "true", if the cache was
+// updated, false if the object is an old version and should be ignored.
+func StoreObjectUpdate(store cache.Store, obj interface{}, className string) (bool, error) {
+	objName, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return false, fmt.Errorf("couldn't get key for object %+v: %v", obj, err)
+	}
+	oldObj, found, err := store.Get(obj)
+	if err != nil {
+		return false, fmt.Errorf("error finding %s %q in controller cache: %v", className, objName, err)
+	}
+
+	objAccessor, err := metaAccessor(obj)
+	if err != nil {
+		return false, err
+	}
+
+	if !found {
+		// This is a new object
+		if err = store.Add(obj); err != nil {
+			return false, fmt.Errorf("error adding %s %q to controller cache: %v", className, objName, err)
+		}
+		return true, nil
+	}
+
+	oldObjAccessor, err := metaAccessor(oldObj)
+	if err != nil {
+		return false, err
+	}
+
+	objResourceVersion, err := strconv.ParseInt(objAccessor.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("error parsing ResourceVersion %q of %s %q: %s", objAccessor.GetResourceVersion(), className, objName, err)
+	}
+	oldObjResourceVersion, err := strconv.ParseInt(oldObjAccessor.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("error parsing ResourceVersion %q of %s %q: %s", oldObjAccessor.GetResourceVersion(), className, objName, err)
+	}
+
+	if oldObjResourceVersion > objResourceVersion {
+		return false, nil
+	}
+
+	// Throw away only older version, let the same version pass - we do want
+	// to run the updateFunc on the newest version again. This holds
+	// regardless of CacheMode: a digest-equality check was tried here to
+	// suppress updates where a CacheModeMetadata object's ResourceVersion
+	// moved but none of its digested fields did, but "same version" already
+	// passes the older-version check above and must be reported, so the only remaining
+	// window for such a check to fire is a genuine version bump - which
+	// this contract says must always be reported. There is no safe place
+	// left to hook in a digest comparison without quietly dropping updates
+	// callers (e.g. a resync after a transient API server error) depend on.
+	if err = store.Update(obj); err != nil {
+		return false, fmt.Errorf("error updating %s %q in controller cache: %v", className, objName, err)
+	}
+	return true, nil
+}
+
+func metaAccessor(obj interface{}) (metav1.Object, error) {
+	accessor, ok := obj.(metav1.Object)
+	if !ok {
+		return nil, fmt.Errorf("object %+v is not a metav1.Object", obj)
+	}
+	return accessor, nil
+}